@@ -0,0 +1,81 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"time"
+)
+
+// maxWindowSize is the upper bound the bdpEstimator is allowed to grow a
+// connection or stream receive window to (16MB, matching gRPC's transport).
+const maxWindowSize = 16 * 1024 * 1024
+
+// bdpPingData is the fixed cookie carried by the PING frame the estimator
+// sends out; any PING ACK whose payload matches it is treated as our own
+// BDP sample rather than a peer-initiated ping.
+var bdpPingData = [8]byte{2, 4, 16, 16, 9, 14, 7, 7}
+
+// bdpEstimator tracks the bandwidth-delay product of the connection so the
+// receive windows can be grown past their static initial size. It is
+// modeled on grpc-go's bdpEstimator.
+type bdpEstimator struct {
+	bdp    uint32 // current BDP estimate
+	sample uint32 // bytes received since the outstanding ping was sent
+	sentAt time.Time
+	isSent bool
+}
+
+// newBDPEstimator returns an estimator seeded at the default window size.
+func newBDPEstimator() *bdpEstimator {
+	return &bdpEstimator{
+		bdp: DEFAULT_WINDOW_SIZE,
+	}
+}
+
+// add accumulates DATA payload bytes received while a BDP ping is
+// outstanding, and returns a PING frame to send if one isn't already in
+// flight.
+func (b *bdpEstimator) add(n uint32) Frame {
+	if b.isSent {
+		b.sample += n
+		return nil
+	}
+	b.isSent = true
+	b.sample = n
+	b.sentAt = time.Now()
+	return NewPingFrame(UNSET, 0, bdpPingData)
+}
+
+// calculate is called when the matching PING ACK arrives. It returns the
+// new BDP estimate and whether it grew enough (by the gamma factor) to act
+// on.
+func (b *bdpEstimator) calculate(data [8]byte) (newBDP uint32, grew bool) {
+	if data != bdpPingData || !b.isSent {
+		return 0, false
+	}
+	rtt := time.Since(b.sentAt)
+	b.isSent = false
+	if rtt <= 0 {
+		b.sample = 0
+		return 0, false
+	}
+
+	// bwe is bytes/sec; the new BDP estimate is bwe*rtt (the bandwidth-delay
+	// product itself), doubled for headroom. bwe*rtt cancels back down to
+	// just the sample, computed this way only to make the formula's
+	// correspondence to the gRPC reference estimator explicit.
+	bwe := uint64(b.sample) * uint64(time.Second) / uint64(rtt)
+	newBDP = uint32(2 * bwe * uint64(rtt) / uint64(time.Second))
+	if newBDP > maxWindowSize {
+		newBDP = maxWindowSize
+	}
+	b.sample = 0
+
+	// gamma: only act on the new estimate if it grew by 1.5x
+	if newBDP < b.bdp+b.bdp/2 {
+		return 0, false
+	}
+	b.bdp = newBDP
+	Debug("bdpEstimator: rtt=%v new bdp=%d", rtt, newBDP)
+	return newBDP, true
+}
@@ -0,0 +1,57 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	"testing"
+	"time"
+)
+
+func TestBdpEstimatorCalculateTracksBandwidthDelayProduct(t *testing.T) {
+	b := newBDPEstimator()
+	b.bdp = 0 // zero baseline so the gamma growth check always passes below
+
+	ping := b.add(1024 * 1024) // 1 MiB sample, starts an outstanding ping
+	pingFrame, ok := ping.(*PingFrame)
+	if !ok {
+		t.Fatalf("add: returned %T, want *PingFrame", ping)
+	}
+	if pingFrame.OpaqueData != bdpPingData {
+		t.Fatalf("add: OpaqueData = %v, want %v", pingFrame.OpaqueData, bdpPingData)
+	}
+	b.sentAt = time.Now().Add(-100 * time.Millisecond) // fake a 100ms RTT
+
+	newBDP, grew := b.calculate(bdpPingData)
+	if !grew {
+		t.Fatal("calculate: expected the estimate to grow from its zero baseline")
+	}
+	// newBDP should track ~2x the sample (the bandwidth-delay product,
+	// doubled for headroom), not 2x the sample further scaled by 1/rtt -
+	// that bug blew straight past maxWindowSize on the first sample.
+	want := uint32(2 * 1024 * 1024)
+	if newBDP < want*9/10 || newBDP > want*11/10 {
+		t.Fatalf("calculate: newBDP = %d, want close to %d", newBDP, want)
+	}
+}
+
+func TestBdpEstimatorCalculateCapsAtMaxWindowSize(t *testing.T) {
+	b := newBDPEstimator()
+	b.bdp = 0
+	b.add(32 * 1024 * 1024) // a sample large enough that 2x blows past the cap
+	b.sentAt = time.Now().Add(-10 * time.Millisecond)
+
+	newBDP, grew := b.calculate(bdpPingData)
+	if !grew {
+		t.Fatal("calculate: expected the estimate to grow from its zero baseline")
+	}
+	if newBDP > maxWindowSize {
+		t.Fatalf("calculate: newBDP = %d, exceeds maxWindowSize %d", newBDP, maxWindowSize)
+	}
+}
+
+func TestBdpEstimatorCalculateIgnoresUnrelatedPingAck(t *testing.T) {
+	b := newBDPEstimator()
+	b.add(1024)
+	if _, grew := b.calculate([8]byte{9, 9, 9, 9, 9, 9, 9, 9}); grew {
+		t.Fatal("calculate: must not report growth for a PING ACK that isn't ours")
+	}
+}
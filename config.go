@@ -1,7 +1,7 @@
 package http2
 
 import (
-	. "github.com/jxck/http2/frame"
+	. "github.com/Jxck/http2/frame"
 )
 
 const (
@@ -11,9 +11,9 @@ const (
 	CONNECTION_PREFACE        = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
 )
 
-var DefaultSettings = map[SettingsId]uint32{
+var DefaultSettings = map[SettingsID]int32{
 	SETTINGS_MAX_CONCURRENT_STREAMS: 100,
 	SETTINGS_INITIAL_WINDOW_SIZE:    DEFAULT_WINDOW_SIZE,
 }
 
-var NilSettings = make(map[SettingsId]uint32, 0)
+var NilSettings = make(map[SettingsID]int32, 0)
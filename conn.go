@@ -8,6 +8,9 @@ import (
 	. "github.com/Jxck/logger"
 	"io"
 	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
 )
 
 func init() {
@@ -15,41 +18,113 @@ func init() {
 }
 
 type Conn struct {
-	RW           io.ReadWriter
-	HpackContext *hpack.Context
-	LastStreamID uint32
-	Window       *Window
-	Settings     map[SettingsID]int32
-	PeerSettings map[SettingsID]int32
-	Streams      map[uint32]*Stream
-	WriteChan    chan Frame
-	CallBack     func(stream *Stream)
+	RW              io.ReadWriter
+	Addr            string         // authority (host:port) this conn was dialed for
+	Pool            ClientConnPool // pool this conn was checked out of, if any
+	HpackContext    *hpack.Context
+	LastStreamID    uint32
+	Window          *Window
+	Settings        map[SettingsID]int32
+	PeerSettings    map[SettingsID]int32
+	mu              sync.Mutex // protects Streams, activeStreams, streamOrder
+	Streams         map[uint32]*Stream
+	nextStreamID    uint32     // atomic; client-initiated streams are odd, starting at 1
+	WriteChan       chan Frame // deprecated: no longer written to; closed by Close() only to unblock any lingering readers
+	CallBack        func(stream *Stream)
+	bdp             *bdpEstimator
+	tuningInitWinID bool // true while our own auto-tuned SETTINGS_INITIAL_WINDOW_SIZE is outstanding
+
+	controlBuf    *controlBuffer        // thin wrapper; put() appends to controlItems below
+	controlItems  []Frame               // control frames queued for loopyWriter: SETTINGS, PING, WINDOW_UPDATE, HEADERS, RST_STREAM, GOAWAY
+	activeStreams map[uint32]*outStream // per-stream queued DATA + send-window, owned by loopyWriter
+	streamOrder   []uint32              // round-robin order over activeStreams
+	writerSignal  *sync.Cond            // wakes loopyWriter when there's new control/data work, window, or close
+	writerClosed  bool                  // true once Close()/controlBuf.close() have run; loopyWriter exits
+
+	MaxHeaderListSize int // cap on a merged HEADERS+CONTINUATION block; 0 means DefaultMaxHeaderListSize
+
+	settingsAckChan        chan struct{} // closed by HandleSettings when our outbound SETTINGS is ACKed
+	awaitingSettingsAck    bool          // true from SendSettings until the ACK arrives; loopyWriter holds DATA meanwhile
+	pendingTableSizeUpdate bool          // a peer SETTINGS_HEADER_TABLE_SIZE change needs signalling on the next outbound header block
+	pendingTableSize       uint32
+
+	peerGoAway    *peerGoAway // set once the peer sends GOAWAY; nil otherwise
+	localShutdown bool        // set once Shutdown() has sent our own GOAWAY; refuses any new incoming stream
 }
 
 func NewConn(rw io.ReadWriter) *Conn {
 	conn := &Conn{
-		RW:           rw,
-		HpackContext: hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
-		Settings:     DefaultSettings,
-		PeerSettings: DefaultSettings,
-		Window:       NewWindowDefault(),
-		Streams:      make(map[uint32]*Stream),
-		WriteChan:    make(chan Frame),
+		RW:            rw,
+		HpackContext:  hpack.NewContext(uint32(DEFAULT_HEADER_TABLE_SIZE)),
+		Settings:      DefaultSettings,
+		PeerSettings:  DefaultSettings,
+		Window:        NewWindowDefault(),
+		Streams:       make(map[uint32]*Stream),
+		nextStreamID:  1,
+		WriteChan:     make(chan Frame),
+		bdp:           newBDPEstimator(),
+		activeStreams: make(map[uint32]*outStream),
 	}
+	conn.writerSignal = sync.NewCond(&conn.mu)
+	conn.controlBuf = newControlBuffer(conn)
 	return conn
 }
 
-func (conn *Conn) NewStream(streamid uint32) *Stream {
-	stream := NewStream(
-		streamid,
-		conn.WriteChan,
-		conn.Settings,
-		conn.PeerSettings,
-		conn.HpackContext,
-		conn.CallBack,
-	)
+// canTakeNewRequest reports whether conn may open another client-initiated
+// stream without exceeding the peer's SETTINGS_MAX_CONCURRENT_STREAMS.
+func (conn *Conn) canTakeNewRequest() bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	max, ok := conn.PeerSettings[SETTINGS_MAX_CONCURRENT_STREAMS]
+	if !ok {
+		return true
+	}
+	return int32(len(conn.Streams)) < max
+}
+
+// RoundTrip allocates a new client-initiated stream, sends req over it and
+// blocks for the response. It implements the per-stream half of
+// http.RoundTripper; ClientConnPool.GetClientConn supplies the Conn.
+func (conn *Conn) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := conn.canCreateStream(); err != nil {
+		return nil, err
+	}
+	if !conn.canTakeNewRequest() {
+		return nil, fmt.Errorf("http2: conn cannot take new request (too many concurrent streams)")
+	}
+
+	streamID := atomic.AddUint32(&conn.nextStreamID, 2) - 2
+
+	conn.mu.Lock()
+	stream, err := conn.NewStream(streamID)
+	if err != nil {
+		conn.mu.Unlock()
+		return nil, err
+	}
+	conn.Streams[streamID] = stream
+	conn.mu.Unlock()
+
+	stream.SendRequest(req)
+	return stream.RecvResponse()
+}
+
+// NewStream builds a Stream for streamid, refusing with a
+// retryable *GoAwayError if either side has already sent GOAWAY: the
+// peer's (covering streams we'd initiate) or our own, via Shutdown
+// (covering streams the peer would initiate on us). It does not add the
+// stream to conn.Streams; callers do that themselves. Callers must already
+// hold conn.mu, matching every existing call site.
+func (conn *Conn) NewStream(streamid uint32) (*Stream, error) {
+	if conn.peerGoAway != nil {
+		return nil, &GoAwayError{LastStreamID: conn.peerGoAway.LastStreamID, ErrCode: conn.peerGoAway.ErrCode}
+	}
+	if conn.localShutdown {
+		return nil, &GoAwayError{LastStreamID: conn.LastStreamID, ErrCode: NO_ERROR}
+	}
+	stream := NewStream(streamid, conn)
 	Debug("adding new stream (id=%d) total (%d)", stream.ID, len(conn.Streams))
-	return stream
+	return stream, nil
 }
 
 func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
@@ -58,6 +133,18 @@ func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
 	if settingsFrame.Flags == ACK {
 		// receive ACK
 		Trace("receive SETTINGS ACK")
+		// any auto-tuned SETTINGS_INITIAL_WINDOW_SIZE of ours is now
+		// acknowledged, so a later peer SETTINGS_INITIAL_WINDOW_SIZE is no
+		// longer deferred (see the tuningInitWinID check below).
+		conn.tuningInitWinID = false
+		conn.mu.Lock()
+		conn.awaitingSettingsAck = false
+		conn.mu.Unlock()
+		conn.writerSignal.Broadcast()
+		if conn.settingsAckChan != nil {
+			close(conn.settingsAckChan)
+			conn.settingsAckChan = nil
+		}
 		return
 	}
 
@@ -70,8 +157,25 @@ func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
 	settings := settingsFrame.Settings
 	conn.Settings = settings
 
+	// SETTINGS_HEADER_TABLE_SIZE
+	conn.handleHeaderTableSize(settings)
+
+	// SETTINGS_MAX_FRAME_SIZE
+	if !conn.handleMaxFrameSize(settings) {
+		return
+	}
+
 	// SETTINGS_INITIAL_WINDOW_SIZE
 	initialWindowSize, ok := settings[SETTINGS_INITIAL_WINDOW_SIZE]
+	if ok && conn.tuningInitWinID {
+		// our own auto-tuned SETTINGS_INITIAL_WINDOW_SIZE (handleBDPPingAck)
+		// is still outstanding: conn.Window.InitialSize already reflects
+		// that unacked value, so applying this peer SETTINGS on top of it
+		// would stack two overlapping delta adjustments onto
+		// PeerCurrentSize. Wait for our own ACK before applying another.
+		Debug("deferring peer SETTINGS_INITIAL_WINDOW_SIZE: our auto-tuned value is still unacked")
+		ok = false
+	}
 	if ok {
 		if initialWindowSize > 65535 { // validate
 			Error("FLOW_CONTROL_ERROR (%s)", "SETTINGS_INITIAL_WINDOW_SIZE too large")
@@ -94,14 +198,14 @@ func (conn *Conn) HandleSettings(settingsFrame *SettingsFrame) {
 
 	// send ACK
 	ack := NewSettingsFrame(ACK, 0, NilSettings)
-	conn.WriteChan <- ack
+	conn.controlBuf.put(ack)
 }
 
 func (conn *Conn) ReadLoop() {
 	Debug("start conn.ReadLoop()")
 	for {
-		// コネクションからフレームを読み込む
-		frame, err := ReadFrame(conn.RW)
+		// コネクションからフレームを読み込む (HEADERS+CONTINUATION はここで合成される)
+		frame, err := conn.readFrame()
 		if err != nil {
 			if err == io.EOF {
 				Error("%v", err)
@@ -130,20 +234,52 @@ func (conn *Conn) ReadLoop() {
 				Error("invalid window update frame %v", frame)
 				return
 			}
-			conn.Window.PeerCurrentSize += int32(windowUpdateFrame.WindowSizeIncrement)
+			conn.onWindowUpdate(0, windowUpdateFrame.WindowSizeIncrement)
+		}
+
+		// Stream Level Window Update: re-queue a stream blocked on send-window
+		if frame.Header().StreamID != 0 && frame.Header().Type == WindowUpdateFrameType {
+			windowUpdateFrame, ok := frame.(*WindowUpdateFrame)
+			if !ok {
+				Error("invalid window update frame %v", frame)
+				return
+			}
+			conn.onWindowUpdate(frame.Header().StreamID, windowUpdateFrame.WindowSizeIncrement)
 		}
 
-		// handle GOAWAY with close connection
+		// handle GOAWAY: record it and let ReadLoop keep running so streams
+		// with ID <= LastStreamID can drain to completion; the transport is
+		// only torn down once every stream finishes (see handleGoAway)
 		if frame.Header().Type == GoAwayFrameType {
-			Debug("stop conn.ReadLoop() by GOAWAY")
-			conn.Close()
-			break
+			goAwayFrame, ok := frame.(*GoAwayFrame)
+			if !ok {
+				Error("invalid goaway frame %v", frame)
+				return
+			}
+			conn.handleGoAway(goAwayFrame)
+			continue
 		}
 
 		// DATA frame なら winodw update
 		if frame.Header().Type == DataFrameType {
 			length := int32(frame.Header().Length)
 			conn.WindowUpdate(length)
+
+			if ping := conn.bdp.add(uint32(length)); ping != nil {
+				conn.controlBuf.put(ping)
+			}
+		}
+
+		// BDP ping ACK なら window を伸ばす
+		if frame.Header().Type == PingFrameType {
+			pingFrame, ok := frame.(*PingFrame)
+			if !ok {
+				Error("invalid ping frame %v", frame)
+				return
+			}
+			if pingFrame.Flags == ACK {
+				conn.handleBDPPingAck(pingFrame)
+			}
 		}
 
 		// 以下 stream leve のコントロール
@@ -154,17 +290,36 @@ func (conn *Conn) ReadLoop() {
 		}
 
 		// 新しいストリーム ID なら対応するストリームを生成
+		conn.mu.Lock()
 		stream, ok := conn.Streams[streamID]
+		isNewStream := !ok
+		var newStreamErr error
 		if !ok {
 			// create stream with streamID
-			stream = conn.NewStream(streamID)
-			conn.Streams[streamID] = stream
-
-			// update last stream id
-			if streamID > conn.LastStreamID {
-				conn.LastStreamID = streamID
+			stream, newStreamErr = conn.NewStream(streamID)
+			if newStreamErr == nil {
+				conn.Streams[streamID] = stream
+
+				// update last stream id
+				if streamID > conn.LastStreamID {
+					conn.LastStreamID = streamID
+				}
 			}
 		}
+		conn.mu.Unlock()
+
+		// we've already sent our own GOAWAY (or the peer sent theirs): refuse
+		// this stream instead of creating and dispatching it.
+		if newStreamErr != nil {
+			Info("refusing new stream(%d): %v", streamID, newStreamErr)
+			conn.controlBuf.put(NewRstStreamFrame(streamID, REFUSED_STREAM))
+			continue
+		}
+
+		// 新しいストリームができたことを呼び出し元 (server.go の ServeConn) に通知する
+		if isNewStream && conn.CallBack != nil {
+			conn.CallBack(stream)
+		}
 
 		// stream の state を変える
 		err = stream.ChangeState(frame, RECV)
@@ -175,7 +330,9 @@ func (conn *Conn) ReadLoop() {
 		// stream が close ならリストから消す
 		if stream.State == CLOSED {
 			Info("remove stream(%d) from conn.Streams[]", streamID)
-			conn.Streams[streamID] = nil
+			conn.mu.Lock()
+			delete(conn.Streams, streamID)
+			conn.mu.Unlock()
 		}
 
 		// ストリームにフレームを渡す
@@ -183,19 +340,12 @@ func (conn *Conn) ReadLoop() {
 	}
 }
 
+// WriteLoop is deprecated: the FIFO WriteChan it drained starved DATA
+// frames behind unrelated small frames and ignored stream priority. Use
+// loopyWriter, which schedules control items and per-stream DATA queues
+// instead.
 func (conn *Conn) WriteLoop() (err error) {
-	Debug("start conn.WriteLoop()")
-	for frame := range conn.WriteChan {
-		Notice("%v %v", Red("send"), util.Indent(frame.String()))
-
-		// TODO: ここで WindowSize を見る
-		err = frame.Write(conn.RW)
-		if err != nil {
-			Error("%v", err)
-			return err
-		}
-	}
-	return
+	return conn.loopyWriter()
 }
 
 func (conn *Conn) WindowUpdate(length int32) {
@@ -206,11 +356,47 @@ func (conn *Conn) WindowUpdate(length int32) {
 	// この値を下回ったら WindowUpdate を送る
 	if conn.Window.CurrentSize < conn.Window.Threshold {
 		update := conn.Window.InitialSize - conn.Window.CurrentSize
-		conn.WriteChan <- NewWindowUpdateFrame(0, uint32(update))
+		conn.controlBuf.put(NewWindowUpdateFrame(0, uint32(update)))
 		conn.Window.CurrentSize = conn.Window.CurrentSize + update
 	}
 }
 
+// handleBDPPingAck reacts to the PING ACK carrying our bdpEstimator's
+// cookie by growing the connection window and announcing a larger
+// SETTINGS_INITIAL_WINDOW_SIZE for every stream.
+func (conn *Conn) handleBDPPingAck(pingFrame *PingFrame) {
+	newBDP, grew := conn.bdp.calculate(pingFrame.OpaqueData)
+	if !grew {
+		return
+	}
+
+	// bdpEstimator.calculate already caps newBDP at maxWindowSize; frame.Window
+	// itself has no such cap (it's the unmodified external type), so that
+	// package-level constant is the connection's window ceiling.
+	if newBDP > maxWindowSize {
+		newBDP = maxWindowSize
+	}
+
+	// conn.Window.CurrentSize is independently refilled by WindowUpdate's
+	// threshold path, so it may already have caught up to (or passed)
+	// newBDP by the time this ACK lands; an unconditional subtraction would
+	// underflow and send a WINDOW_UPDATE increment near 2^32, violating the
+	// 2^31-1 limit in RFC 7540 6.9.
+	if newBDP <= uint32(conn.Window.CurrentSize) {
+		return
+	}
+	increment := newBDP - uint32(conn.Window.CurrentSize)
+	conn.controlBuf.put(NewWindowUpdateFrame(0, increment))
+	conn.Window.CurrentSize = int32(newBDP)
+	conn.Window.InitialSize = int32(newBDP)
+
+	conn.tuningInitWinID = true
+	settings := map[SettingsID]int32{
+		SETTINGS_INITIAL_WINDOW_SIZE: int32(newBDP),
+	}
+	conn.controlBuf.put(NewSettingsFrame(UNSET, 0, settings))
+}
+
 func (conn *Conn) WriteMagic() (err error) {
 	_, err = conn.RW.Write([]byte(CONNECTION_PREFACE))
 	if err != nil {
@@ -236,12 +422,26 @@ func (conn *Conn) ReadMagic() (err error) {
 
 func (conn *Conn) Close() {
 	Info("close all conn.Streams")
-	for i, stream := range conn.Streams {
-		if stream != nil {
-			Debug("close stream(%d)", i)
-			stream.Close()
-		}
+
+	conn.mu.Lock()
+	// whichever GOAWAY (theirs or a Shutdown of our own) is driving this
+	// Close is the right reason to hand every still-open stream, so its
+	// Recv can return a distinguishable *GoAwayError instead of hanging.
+	goAwayErr := &GoAwayError{LastStreamID: conn.LastStreamID, ErrCode: NO_ERROR}
+	if conn.peerGoAway != nil {
+		goAwayErr = &GoAwayError{LastStreamID: conn.peerGoAway.LastStreamID, ErrCode: conn.peerGoAway.ErrCode}
+	}
+	streams := conn.Streams
+	conn.Streams = make(map[uint32]*Stream)
+	conn.mu.Unlock()
+
+	for i, stream := range streams {
+		Debug("close stream(%d)", i)
+		stream.Close(goAwayErr)
 	}
+
 	Info("close conn.WriteChan")
 	close(conn.WriteChan)
+	conn.controlBuf.close()
+	conn.writerSignal.Broadcast()
 }
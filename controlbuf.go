@@ -0,0 +1,223 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+)
+
+// dataItem is one chunk of a stream's outbound DATA payload queued for the
+// loopyWriter, along with whether it carries END_STREAM.
+type dataItem struct {
+	p         []byte
+	endStream bool
+}
+
+// outStream is the loopyWriter's per-stream write state: a FIFO of queued
+// DATA chunks and that stream's outbound flow-control balance.
+type outStream struct {
+	id     uint32
+	queue  []dataItem
+	window int32 // bytes this stream is currently allowed to send
+}
+
+func (s *outStream) hasData() bool {
+	return len(s.queue) > 0
+}
+
+// controlBuffer is a FIFO of control frames (SETTINGS, PING, WINDOW_UPDATE,
+// HEADERS, RST_STREAM, GOAWAY) that loopyWriter drains ahead of any queued
+// DATA, so control traffic is never starved behind bulk transfers. It is a
+// thin, conn-mutex-guarded wrapper rather than owning its own lock: every
+// write to conn.RW must happen from loopyWriter's single goroutine, so the
+// queue it drains has to be guarded by the same conn.mu/writerSignal that
+// goroutine already waits on for DATA work.
+type controlBuffer struct {
+	conn *Conn
+}
+
+func newControlBuffer(conn *Conn) *controlBuffer {
+	return &controlBuffer{conn: conn}
+}
+
+// put enqueues a control frame and wakes the loopyWriter.
+func (cb *controlBuffer) put(item Frame) {
+	conn := cb.conn
+	conn.mu.Lock()
+	if conn.writerClosed {
+		conn.mu.Unlock()
+		return
+	}
+	conn.controlItems = append(conn.controlItems, item)
+	conn.mu.Unlock()
+	conn.writerSignal.Signal()
+}
+
+// close stops the loopyWriter from accepting any further control items or
+// DATA; already-queued writes are dropped, not flushed.
+func (cb *controlBuffer) close() {
+	conn := cb.conn
+	conn.mu.Lock()
+	conn.writerClosed = true
+	conn.mu.Unlock()
+	conn.writerSignal.Broadcast()
+}
+
+// writeData enqueues p as a DATA frame for this stream with the
+// loopyWriter, to be chopped and sent as send-window allows. This is the
+// replacement for sending DataFrames directly over conn.WriteChan.
+func (stream *Stream) writeData(p []byte, endStream bool) {
+	conn := stream.Conn
+	conn.mu.Lock()
+	out, ok := conn.activeStreams[stream.ID]
+	if !ok {
+		out = &outStream{id: stream.ID, window: conn.Window.InitialSize}
+		conn.activeStreams[stream.ID] = out
+		conn.streamOrder = append(conn.streamOrder, stream.ID)
+	}
+	out.queue = append(out.queue, dataItem{p: p, endStream: endStream})
+	conn.mu.Unlock()
+
+	conn.writerSignal.Signal()
+}
+
+// loopyWriter is the single goroutine that owns conn.RW for writes: every
+// write site in the package (control frames via conn.controlBuf.put, DATA
+// via Stream.writeData) only ever enqueues, it never writes conn.RW
+// itself, so there is exactly one writer and no interleaving/corruption
+// on the wire. Each pass drains every queued control item first (they
+// must never be starved behind bulk DATA), then does one round-robin pass
+// over conn.activeStreams that have both queued bytes and positive
+// send-window, chopping each write to the smallest of the stream window,
+// the connection window and the peer's SETTINGS_MAX_FRAME_SIZE.
+func (conn *Conn) loopyWriter() error {
+	Debug("start conn.loopyWriter()")
+
+	for {
+		conn.mu.Lock()
+		for len(conn.controlItems) == 0 && len(conn.activeStreams) == 0 && !conn.writerClosed {
+			conn.writerSignal.Wait()
+		}
+		if conn.writerClosed {
+			conn.mu.Unlock()
+			return nil
+		}
+		items := conn.controlItems
+		conn.controlItems = nil
+		// a real copy, not a slice-header alias of conn.streamOrder: this
+		// loop's own removeStreamOrder calls below mutate conn.streamOrder's
+		// backing array in place, which would otherwise shift elements out
+		// from under the iteration over order and cause it to skip/revisit
+		// entries mid-pass.
+		order := append([]uint32(nil), conn.streamOrder...)
+		conn.mu.Unlock()
+
+		for _, item := range items {
+			Notice("%v %v", Red("send"), item.String())
+			if err := item.Write(conn.RW); err != nil {
+				Error("%v", err)
+				return err
+			}
+		}
+
+		wrote := false
+		for _, id := range order {
+			conn.mu.Lock()
+			// our outbound SETTINGS (SendSettings) hasn't been ACKed yet:
+			// hold all DATA until it is, since window accounting may still
+			// change underneath it (SETTINGS_INITIAL_WINDOW_SIZE in
+			// particular). Control items above are unaffected - those are
+			// what carry the ACK in the first place.
+			if conn.awaitingSettingsAck {
+				conn.mu.Unlock()
+				break
+			}
+			out, ok := conn.activeStreams[id]
+			if !ok || !out.hasData() || out.window <= 0 || conn.Window.PeerCurrentSize <= 0 {
+				conn.mu.Unlock()
+				continue
+			}
+
+			item := out.queue[0]
+			n := len(item.p)
+			max := conn.peerMaxFrameSize()
+			if n > int(out.window) {
+				n = int(out.window)
+			}
+			if int32(n) > conn.Window.PeerCurrentSize {
+				n = int(conn.Window.PeerCurrentSize)
+			}
+			if n > max {
+				n = max
+			}
+
+			chunk := item.p[:n]
+			item.p = item.p[n:]
+			endStream := item.endStream && len(item.p) == 0
+
+			out.window -= int32(n)
+			conn.Window.PeerCurrentSize -= int32(n)
+
+			if len(item.p) == 0 {
+				out.queue = out.queue[1:]
+				if !out.hasData() {
+					delete(conn.activeStreams, id)
+					conn.removeStreamOrder(id)
+				}
+			} else {
+				out.queue[0] = item
+			}
+			conn.mu.Unlock()
+
+			flags := UNSET
+			if endStream {
+				flags = END_STREAM
+			}
+			frame := NewDataFrame(flags, id)
+			frame.Data = chunk
+			frame.Length = uint16(len(chunk))
+			if err := frame.Write(conn.RW); err != nil {
+				return err
+			}
+			wrote = true
+		}
+
+		if !wrote {
+			// nothing sendable right now (blocked on window); wait for a
+			// WINDOW_UPDATE, new control item or close to re-signal us.
+			conn.mu.Lock()
+			if len(conn.controlItems) == 0 && len(conn.activeStreams) > 0 {
+				conn.writerSignal.Wait()
+			}
+			conn.mu.Unlock()
+		}
+	}
+}
+
+func (conn *Conn) peerMaxFrameSize() int {
+	if size, ok := conn.PeerSettings[SETTINGS_MAX_FRAME_SIZE]; ok {
+		return int(size)
+	}
+	return DEFAULT_MAX_FRAME_SIZE
+}
+
+func (conn *Conn) removeStreamOrder(id uint32) {
+	for i, sid := range conn.streamOrder {
+		if sid == id {
+			conn.streamOrder = append(conn.streamOrder[:i], conn.streamOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+// onWindowUpdate re-queues a stream (or every stream, for a connection
+// level update) that may have been blocked waiting on send-window.
+func (conn *Conn) onWindowUpdate(streamID uint32, increment uint32) {
+	conn.mu.Lock()
+	if streamID == 0 {
+		conn.Window.PeerCurrentSize += int32(increment)
+	} else if out, ok := conn.activeStreams[streamID]; ok {
+		out.window += int32(increment)
+	}
+	conn.mu.Unlock()
+	conn.writerSignal.Signal()
+}
@@ -0,0 +1,45 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	"testing"
+)
+
+func TestRemoveStreamOrder(t *testing.T) {
+	conn := &Conn{streamOrder: []uint32{1, 2, 3, 4}}
+	conn.removeStreamOrder(2)
+
+	want := []uint32{1, 3, 4}
+	if len(conn.streamOrder) != len(want) {
+		t.Fatalf("streamOrder = %v, want %v", conn.streamOrder, want)
+	}
+	for i := range want {
+		if conn.streamOrder[i] != want[i] {
+			t.Fatalf("streamOrder = %v, want %v", conn.streamOrder, want)
+		}
+	}
+}
+
+func TestRemoveStreamOrderMissingIDIsNoop(t *testing.T) {
+	conn := &Conn{streamOrder: []uint32{1, 2, 3}}
+	conn.removeStreamOrder(99)
+
+	want := []uint32{1, 2, 3}
+	if len(conn.streamOrder) != len(want) {
+		t.Fatalf("streamOrder = %v, want unchanged %v", conn.streamOrder, want)
+	}
+}
+
+func TestPeerMaxFrameSizeDefault(t *testing.T) {
+	conn := &Conn{PeerSettings: map[SettingsID]int32{}}
+	if got := conn.peerMaxFrameSize(); got != DEFAULT_MAX_FRAME_SIZE {
+		t.Fatalf("peerMaxFrameSize() = %d, want %d", got, DEFAULT_MAX_FRAME_SIZE)
+	}
+}
+
+func TestPeerMaxFrameSizeConfigured(t *testing.T) {
+	conn := &Conn{PeerSettings: map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: 20000}}
+	if got := conn.peerMaxFrameSize(); got != 20000 {
+		t.Fatalf("peerMaxFrameSize() = %d, want 20000", got)
+	}
+}
@@ -0,0 +1,83 @@
+package http2
+
+import (
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+)
+
+// DefaultMaxHeaderListSize bounds the accumulated HEADERS(+CONTINUATION)
+// block size mergeContinuations will merge before giving up with
+// ENHANCE_YOUR_CALM, when Conn.MaxHeaderListSize is left at 0.
+const DefaultMaxHeaderListSize = 16 * 1024 * 1024
+
+// readFrame reads one logical frame off rw. HTTP/2 lets a peer split a
+// header block across a HEADERS (or PUSH_PROMISE) frame with END_HEADERS
+// unset and one or more trailing CONTINUATION frames; no other frame may
+// be interleaved on the wire while that's happening. HPACK's dynamic
+// table is only well-defined once the whole block is assembled, so this
+// merges the fragments here rather than letting callers see partial
+// header frames.
+func (conn *Conn) readFrame() (Frame, error) {
+	frame, err := ReadFrame(conn.RW)
+	if err != nil {
+		return nil, err
+	}
+
+	switch f := frame.(type) {
+	case *HeadersFrame:
+		if f.Flags&END_HEADERS == 0 {
+			if err := conn.mergeContinuations(f.Header().StreamID, &f.HeaderBlock); err != nil {
+				return nil, err
+			}
+			f.Flags |= END_HEADERS
+			f.Length = uint16(len(f.HeaderBlock))
+		}
+		return f, nil
+	case *PushPromiseFrame:
+		if f.Flags&END_HEADERS == 0 {
+			if err := conn.mergeContinuations(f.Header().StreamID, &f.HeaderBlock); err != nil {
+				return nil, err
+			}
+			f.Flags |= END_HEADERS
+			f.Length = uint16(len(f.HeaderBlock))
+		}
+		return f, nil
+	default:
+		return frame, nil
+	}
+}
+
+// mergeContinuations reads and appends CONTINUATION frames for streamID
+// onto *block until one arrives with END_HEADERS set.
+func (conn *Conn) mergeContinuations(streamID uint32, block *[]byte) error {
+	maxHeaderListSize := conn.MaxHeaderListSize
+	if maxHeaderListSize == 0 {
+		maxHeaderListSize = DefaultMaxHeaderListSize
+	}
+
+	for {
+		next, err := ReadFrame(conn.RW)
+		if err != nil {
+			return err
+		}
+
+		cont, ok := next.(*ContinuationFrame)
+		if !ok || cont.Header().StreamID != streamID {
+			Error("PROTOCOL_ERROR: expected CONTINUATION for stream %d, got %v", streamID, next)
+			conn.controlBuf.put(NewGoAwayFrame(conn.LastStreamID, PROTOCOL_ERROR, []byte{}))
+			return fmt.Errorf("http2: PROTOCOL_ERROR: expected CONTINUATION for stream %d", streamID)
+		}
+
+		*block = append(*block, cont.HeaderBlock...)
+		if len(*block) > maxHeaderListSize {
+			Error("ENHANCE_YOUR_CALM: header block exceeds MaxHeaderListSize (%d)", maxHeaderListSize)
+			conn.controlBuf.put(NewGoAwayFrame(conn.LastStreamID, ENHANCE_YOUR_CALM, []byte{}))
+			return fmt.Errorf("http2: ENHANCE_YOUR_CALM: header block too large")
+		}
+
+		if cont.Flags&END_HEADERS != 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package http2
+
+import (
+	"crypto/tls"
+	. "github.com/Jxck/logger"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ClientConnPool manages reuse of Conns across requests so that many
+// concurrent http.Requests to the same authority share one HTTP/2
+// connection instead of each dialing and handshaking independently.
+type ClientConnPool interface {
+	GetClientConn(req *http.Request, addr string) (*Conn, error)
+	MarkDead(*Conn)
+}
+
+// clientConnPool is the default ClientConnPool, keyed by "host:port".
+type clientConnPool struct {
+	mu    sync.Mutex
+	conns map[string]*Conn
+}
+
+func NewClientConnPool() *clientConnPool {
+	return &clientConnPool{
+		conns: make(map[string]*Conn),
+	}
+}
+
+// GetClientConn returns a Conn for addr, reusing a live one when possible
+// and able to take the request, otherwise dialing a fresh connection.
+// req.URL.Scheme decides whether that dial negotiates TLS+ALPN or, for
+// "http://" requests Transport has already cleared via AllowHTTP, speaks
+// h2c prior-knowledge over a plaintext TCP connection.
+func (p *clientConnPool) GetClientConn(req *http.Request, addr string) (*Conn, error) {
+	p.mu.Lock()
+	conn, ok := p.conns[addr]
+	p.mu.Unlock()
+
+	if ok && conn.canTakeNewRequest() {
+		return conn, nil
+	}
+
+	conn, err := p.dial(addr, req.URL.Scheme == "http")
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.conns[addr] = conn
+	p.mu.Unlock()
+
+	return conn, nil
+}
+
+// dial opens a new connection to addr, performs the HTTP/2 preface and
+// starts the conn's read/write loops. Unless plaintext is set it's a TLS
+// connection negotiating the "h2" ALPN protocol; plaintext is the h2c
+// prior-knowledge fallback for "http://" requests, with no TLS/ALPN step
+// at all since both ends already agree on HTTP/2 out of band.
+func (p *clientConnPool) dial(addr string, plaintext bool) (*Conn, error) {
+	var rw net.Conn
+	if plaintext {
+		tcpConn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		rw = tcpConn
+	} else {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+
+		tlsConn, err := tls.Dial("tcp", addr, &tls.Config{
+			ServerName: host,
+			NextProtos: []string{OVER_TLS},
+		})
+		if err != nil {
+			return nil, err
+		}
+		rw = tlsConn
+	}
+
+	conn := NewConn(rw)
+	conn.Addr = addr
+	conn.Pool = p
+
+	if err := conn.WriteMagic(); err != nil {
+		rw.Close()
+		return nil, err
+	}
+
+	go conn.ReadLoop()
+	go conn.loopyWriter()
+
+	// block until the peer ACKs our SETTINGS, so loopyWriter never sends
+	// DATA against window accounting the handshake might still change.
+	if err := conn.SendSettings(conn.Settings); err != nil {
+		rw.Close()
+		return nil, err
+	}
+
+	Info("clientConnPool: dialed new conn to %s (plaintext=%v)", addr, plaintext)
+	return conn, nil
+}
+
+// MarkDead removes conn from the pool so a later GetClientConn dials a
+// fresh connection instead of reusing it. In-flight streams on conn are
+// left to complete on their own; MarkDead only affects future lookups.
+func (p *clientConnPool) MarkDead(conn *Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, c := range p.conns {
+		if c == conn {
+			delete(p.conns, addr)
+		}
+	}
+}
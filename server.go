@@ -0,0 +1,230 @@
+package http2
+
+import (
+	"bytes"
+	"crypto/tls"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// newBodyReader wraps a fully-buffered request body as an io.ReadCloser
+// for http.Request.Body.
+func newBodyReader(p []byte) io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(p))
+}
+
+// Server holds the HTTP/2-specific settings ConfigureServer wires into an
+// *http.Server so its existing http.Handler can be driven over h2.
+type Server struct {
+	MaxConcurrentStreams uint32
+	MaxHeaderListSize    int
+}
+
+// ConfigureServer adds h2-over-TLS support to s, dispatching to s.Handler
+// once a request stream completes. It does nothing for h2c; a plaintext
+// prior-knowledge connection is served by calling ServeConn on it directly.
+// It mirrors golang.org/x/net/http2's ConfigureServer: it only registers
+// the necessary TLSNextProto hook, it does not itself listen.
+func ConfigureServer(s *http.Server, conf *Server) error {
+	if conf == nil {
+		conf = new(Server)
+	}
+	if s.TLSConfig == nil {
+		s.TLSConfig = new(tls.Config)
+	}
+	s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, OVER_TLS)
+
+	if s.TLSNextProto == nil {
+		s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	s.TLSNextProto[OVER_TLS] = func(hs *http.Server, c *tls.Conn, h http.Handler) {
+		ServeConn(c, &ServeConnOpts{
+			Server:     conf,
+			Handler:    h,
+			BaseConfig: hs,
+		})
+	}
+	return nil
+}
+
+// ServeConnOpts bundles the inputs ServeConn needs beyond the net.Conn
+// itself.
+type ServeConnOpts struct {
+	Server     *Server
+	Handler    http.Handler
+	BaseConfig *http.Server
+}
+
+func (o *ServeConnOpts) handler() http.Handler {
+	if o.Handler != nil {
+		return o.Handler
+	}
+	if o.BaseConfig != nil && o.BaseConfig.Handler != nil {
+		return o.BaseConfig.Handler
+	}
+	return http.DefaultServeMux
+}
+
+// ServeConn runs the server side of the HTTP/2 protocol over c: it reads
+// the connection preface, starts the read/write loops, and for every
+// fully-received request stream builds an *http.Request and dispatches it
+// to opts.Handler, translating ResponseWriter calls back into frames.
+func ServeConn(c net.Conn, opts *ServeConnOpts) {
+	conn := NewConn(c)
+	if opts.Server != nil && opts.Server.MaxHeaderListSize != 0 {
+		conn.MaxHeaderListSize = opts.Server.MaxHeaderListSize
+	}
+
+	if err := conn.ReadMagic(); err != nil {
+		Error("%v", err)
+		c.Close()
+		return
+	}
+
+	go conn.loopyWriter()
+
+	conn.CallBack = func(stream *Stream) {
+		go serveStream(conn, stream, opts.handler())
+	}
+
+	// ReadLoop below is what actually receives the ACK, so SendSettings has
+	// to run concurrently with it rather than before; loopyWriter holds all
+	// DATA until awaitingSettingsAck clears regardless of ordering here.
+	go func() {
+		if err := conn.SendSettings(conn.Settings); err != nil {
+			Error("%v", err)
+		}
+	}()
+
+	conn.ReadLoop()
+}
+
+// serveStream waits for stream's request HEADERS(+DATA) to complete,
+// builds an *http.Request from the h2 pseudo-headers and dispatches it to
+// handler, streaming the response back as HEADERS+DATA.
+func serveStream(conn *Conn, stream *Stream, handler http.Handler) {
+	req, err := stream.recvRequest()
+	if err != nil {
+		Error("%v", err)
+		return
+	}
+
+	rw := &responseWriter{stream: stream, header: http.Header{}}
+	handler.ServeHTTP(rw, req)
+	rw.finish()
+}
+
+// recvRequest reads frames until the request is fully received and builds
+// an *http.Request, mapping the ":method", ":path", ":scheme" and
+// ":authority" pseudo-headers onto the stdlib request fields.
+func (stream *Stream) recvRequest() (*http.Request, error) {
+	header := http.Header{}
+	body := []byte{}
+
+	for {
+		frame, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		h := frame.Header()
+
+		if h.Type == HeadersFrameType {
+			hf := frame.(*HeadersFrame)
+			header = hf.Headers
+		}
+		if h.Type == DataFrameType {
+			df := frame.(*DataFrame)
+			body = append(body, df.Data...)
+		}
+		if h.Flags&END_STREAM != 0 {
+			break
+		}
+	}
+
+	method := header.Get(":method")
+	path := header.Get(":path")
+	scheme := header.Get(":scheme")
+	authority := header.Get(":authority")
+
+	header.Del(":method")
+	header.Del(":path")
+	header.Del(":scheme")
+	header.Del(":authority")
+
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = scheme
+	u.Host = authority
+
+	req := &http.Request{
+		Method:        method,
+		URL:           u,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		ProtoMinor:    0,
+		Header:        header,
+		Body:          newBodyReader(body),
+		ContentLength: int64(len(body)),
+		Host:          authority,
+		RemoteAddr:    stream.Conn.RW.(net.Conn).RemoteAddr().String(),
+	}
+	return req, nil
+}
+
+// responseWriter adapts an http.ResponseWriter onto a Stream: the first
+// Write (or an explicit WriteHeader) flushes a HEADERS frame carrying the
+// ":status" pseudo-header, and body bytes are queued as DATA via
+// stream.writeData so they flow through the loopyWriter's scheduler.
+type responseWriter struct {
+	stream      *Stream
+	header      http.Header
+	wroteHeader bool
+	status      int
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.status = status
+
+	rw.header.Set(":status", strconv.Itoa(status))
+	frame := NewHeadersFrame(END_HEADERS, rw.stream.ID)
+	frame.Headers = rw.header
+	frame.HeaderBlock = rw.stream.Conn.EncodeHeader(frame.Headers)
+	frame.Length = uint16(len(frame.HeaderBlock))
+	// Stream.Send puts non-DATA frames straight onto conn.controlBuf, so
+	// this HEADERS frame goes through loopyWriter's single writer same as
+	// every other control frame rather than bypassing the scheduler.
+	rw.stream.Send(frame)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.stream.writeData(p, false)
+	return len(p), nil
+}
+
+// finish sends the final, empty END_STREAM DATA frame closing the
+// response once the handler returns.
+func (rw *responseWriter) finish() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	rw.stream.writeData([]byte{}, true)
+}
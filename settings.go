@@ -0,0 +1,78 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"net/http"
+)
+
+const (
+	minMaxFrameSize = 16384
+	maxMaxFrameSize = 16777215
+)
+
+// SendSettings transmits our preferred SETTINGS values at connection
+// start and blocks until the peer's ACK arrives, so no DATA is written
+// against window accounting that might still change underneath it.
+func (conn *Conn) SendSettings(settings map[SettingsID]int32) error {
+	conn.mu.Lock()
+	conn.settingsAckChan = make(chan struct{})
+	conn.awaitingSettingsAck = true
+	conn.mu.Unlock()
+
+	conn.controlBuf.put(NewSettingsFrame(UNSET, 0, settings))
+	<-conn.settingsAckChan
+	return nil
+}
+
+// EncodeHeader runs header through the connection's HPACK encoder. If the
+// peer's SETTINGS_HEADER_TABLE_SIZE handler requested a dynamic-table-size
+// update, it is signalled here as a leading size-update entry so the
+// encoder and decoder's table sizes stay in sync, per RFC 7541 6.3.
+func (conn *Conn) EncodeHeader(header http.Header) []byte {
+	var update []byte
+	if conn.pendingTableSizeUpdate {
+		conn.pendingTableSizeUpdate = false
+		conn.HpackContext.SetMaxDynamicTableSize(conn.pendingTableSize)
+		// '001' pattern with the size as a 5-bit-prefix integer (RFC 7541 5.1)
+		size := conn.pendingTableSize
+		if size < 31 {
+			update = []byte{0x20 | byte(size)}
+		} else {
+			update = []byte{0x20 | 31}
+			for size -= 31; size >= 128; size >>= 7 {
+				update = append(update, byte(size%128)|0x80)
+			}
+			update = append(update, byte(size))
+		}
+	}
+	return append(update, conn.HpackContext.Encode(header)...)
+}
+
+func (conn *Conn) handleHeaderTableSize(settings map[SettingsID]int32) {
+	newSize, ok := settings[SETTINGS_HEADER_TABLE_SIZE]
+	if !ok {
+		return
+	}
+	conn.HpackContext.SetMaxDynamicTableSize(uint32(newSize))
+	conn.pendingTableSizeUpdate = true
+	conn.pendingTableSize = uint32(newSize)
+}
+
+// handleMaxFrameSize validates the peer's SETTINGS_MAX_FRAME_SIZE and, if
+// valid, stores it so loopyWriter chops DATA frames no larger than it
+// allows. An out-of-range value is a FRAME_SIZE_ERROR: a GOAWAY is queued
+// and false is returned; the connection itself is not closed here.
+func (conn *Conn) handleMaxFrameSize(settings map[SettingsID]int32) bool {
+	newSize, ok := settings[SETTINGS_MAX_FRAME_SIZE]
+	if !ok {
+		return true
+	}
+	if newSize < minMaxFrameSize || newSize > maxMaxFrameSize {
+		Error("FRAME_SIZE_ERROR: SETTINGS_MAX_FRAME_SIZE out of range (%d)", newSize)
+		conn.controlBuf.put(NewGoAwayFrame(conn.LastStreamID, FRAME_SIZE_ERROR, []byte{}))
+		return false
+	}
+	conn.PeerSettings[SETTINGS_MAX_FRAME_SIZE] = newSize
+	return true
+}
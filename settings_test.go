@@ -0,0 +1,49 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	"testing"
+)
+
+func TestHandleMaxFrameSizeValid(t *testing.T) {
+	conn := NewConn(nil)
+	// NewConn seeds PeerSettings from the shared DefaultSettings map; give
+	// the test its own copy so it doesn't mutate package-level state.
+	conn.PeerSettings = map[SettingsID]int32{}
+	if !conn.handleMaxFrameSize(map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: 20000}) {
+		t.Fatal("handleMaxFrameSize: expected an in-range size to be accepted")
+	}
+	if conn.PeerSettings[SETTINGS_MAX_FRAME_SIZE] != 20000 {
+		t.Fatalf("PeerSettings[SETTINGS_MAX_FRAME_SIZE] = %d, want 20000", conn.PeerSettings[SETTINGS_MAX_FRAME_SIZE])
+	}
+}
+
+func TestHandleMaxFrameSizeTooSmallIsRejected(t *testing.T) {
+	conn := NewConn(nil)
+	conn.PeerSettings = map[SettingsID]int32{}
+	if conn.handleMaxFrameSize(map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: minMaxFrameSize - 1}) {
+		t.Fatal("handleMaxFrameSize: expected a too-small size to be rejected")
+	}
+	if len(conn.controlItems) != 1 {
+		t.Fatalf("expected a queued GOAWAY, got %d control items", len(conn.controlItems))
+	}
+}
+
+func TestHandleMaxFrameSizeTooLargeIsRejected(t *testing.T) {
+	conn := NewConn(nil)
+	conn.PeerSettings = map[SettingsID]int32{}
+	if conn.handleMaxFrameSize(map[SettingsID]int32{SETTINGS_MAX_FRAME_SIZE: maxMaxFrameSize + 1}) {
+		t.Fatal("handleMaxFrameSize: expected a too-large size to be rejected")
+	}
+}
+
+func TestHandleMaxFrameSizeAbsentIsNoop(t *testing.T) {
+	conn := NewConn(nil)
+	conn.PeerSettings = map[SettingsID]int32{}
+	if !conn.handleMaxFrameSize(map[SettingsID]int32{}) {
+		t.Fatal("handleMaxFrameSize: absent SETTINGS_MAX_FRAME_SIZE should be a no-op success")
+	}
+	if len(conn.controlItems) != 0 {
+		t.Fatalf("expected no control items queued, got %d", len(conn.controlItems))
+	}
+}
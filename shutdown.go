@@ -0,0 +1,125 @@
+package http2
+
+import (
+	"context"
+	"fmt"
+	. "github.com/Jxck/http2/frame"
+	. "github.com/Jxck/logger"
+	"time"
+)
+
+// GracefulTimeout bounds how long a Conn waits for in-flight streams to
+// drain after the peer's GOAWAY before it gives up and closes anyway. Zero
+// means wait forever. Shutdown (our own GOAWAY) is bounded by its ctx
+// instead.
+var GracefulTimeout = 30 * time.Second
+
+// peerGoAway records the peer's GOAWAY so ReadLoop can keep draining
+// existing streams while refusing to start new ones.
+type peerGoAway struct {
+	LastStreamID uint32
+	ErrCode      ErrCode
+	DebugData    []byte
+}
+
+// GoAwayError is returned by RoundTrip (and surfaced from NewStream) for a
+// request that was aborted because a GOAWAY (the peer's, or our own from
+// Shutdown) was sent before it could run to completion. Transport.RoundTrip type-asserts this to retry the
+// request on a fresh connection.
+type GoAwayError struct {
+	LastStreamID uint32
+	ErrCode      ErrCode
+}
+
+func (e *GoAwayError) Error() string {
+	return fmt.Sprintf("http2: GOAWAY received (LastStreamID=%d, ErrCode=%v)", e.LastStreamID, e.ErrCode)
+}
+
+// handleGoAway records the peer's GOAWAY and stops ReadLoop from closing
+// the connection outright: streams already open below LastStreamID are
+// left to drain normally, new ones are refused, and the transport is only
+// torn down once every stream finishes or GracefulTimeout elapses.
+func (conn *Conn) handleGoAway(frame *GoAwayFrame) {
+	Debug("received GOAWAY (LastStreamID=%d)", frame.LastStreamID)
+
+	conn.mu.Lock()
+	conn.peerGoAway = &peerGoAway{
+		LastStreamID: frame.LastStreamID,
+		ErrCode:      frame.ErrCode,
+		DebugData:    frame.DebugData,
+	}
+	remaining := len(conn.Streams)
+	conn.mu.Unlock()
+
+	if conn.Pool != nil {
+		conn.Pool.MarkDead(conn)
+	}
+
+	if remaining == 0 {
+		conn.Close()
+		return
+	}
+
+	go conn.waitDrainThenClose()
+}
+
+// waitDrainThenClose blocks until every stream has finished (polling,
+// since Streams is mutated from ReadLoop) or GracefulTimeout elapses,
+// then tears down the transport.
+func (conn *Conn) waitDrainThenClose() {
+	deadline := time.Now().Add(GracefulTimeout)
+	for GracefulTimeout == 0 || time.Now().Before(deadline) {
+		conn.mu.Lock()
+		remaining := len(conn.Streams)
+		conn.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+}
+
+// canCreateStream reports whether a new client-initiated stream may still
+// be opened, i.e. the peer hasn't sent GOAWAY.
+func (conn *Conn) canCreateStream() error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.peerGoAway != nil {
+		return &GoAwayError{LastStreamID: conn.peerGoAway.LastStreamID, ErrCode: conn.peerGoAway.ErrCode}
+	}
+	return nil
+}
+
+// Shutdown performs our half of a graceful two-phase close: it sends
+// GOAWAY with the highest stream ID we've accepted so far, waits (bounded
+// by ctx) for those streams to finish, then sends a second, final GOAWAY
+// before closing the transport.
+func (conn *Conn) Shutdown(ctx context.Context) error {
+	conn.mu.Lock()
+	lastStreamID := conn.LastStreamID
+	conn.localShutdown = true
+	conn.mu.Unlock()
+
+	conn.controlBuf.put(NewGoAwayFrame(lastStreamID, NO_ERROR, []byte{}))
+
+	for {
+		conn.mu.Lock()
+		remaining := len(conn.Streams)
+		conn.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			conn.controlBuf.put(NewGoAwayFrame(lastStreamID, NO_ERROR, []byte{}))
+			conn.Close()
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	conn.controlBuf.put(NewGoAwayFrame(lastStreamID, NO_ERROR, []byte{}))
+	conn.Close()
+	return nil
+}
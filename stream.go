@@ -2,6 +2,7 @@ package http2
 
 import (
 	"bytes"
+	. "github.com/Jxck/http2/frame"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,53 +13,162 @@ func init() {
 	log.SetFlags(log.Lshortfile)
 }
 
+// StreamState is the stream's position in the HTTP/2 state machine
+// (RFC 7540 5.1).
+type StreamState int
+
+const (
+	IDLE StreamState = iota
+	RESERVED_LOCAL
+	RESERVED_REMOTE
+	OPEN
+	HALF_CLOSED_LOCAL
+	HALF_CLOSED_REMOTE
+	CLOSED
+)
+
+// Direction distinguishes a frame ChangeState is applied for as either
+// outbound (SEND) or inbound (RECV), since END_STREAM closes a different
+// half of the stream depending on which way it travelled.
+type Direction int
+
+const (
+	SEND Direction = iota
+	RECV
+)
+
 type Stream struct {
-	Id   uint32
-	Conn *Conn
-	req  *http.Request
+	ID           uint32
+	Conn         *Conn
+	Window       *Window
+	Settings     map[SettingsID]int32
+	PeerSettings map[SettingsID]int32
+	State        StreamState
+	ReadChan     chan Frame
+	err          error // set by Close, returned by Recv once ReadChan drains
+	req          *http.Request
 }
 
+// NewStream builds a Stream bound to conn, seeded with conn's current
+// settings and a fresh flow-control window. Conn.NewStream is the usual
+// caller; neither of them registers the stream in conn.Streams.
+func NewStream(id uint32, conn *Conn) *Stream {
+	return &Stream{
+		ID:           id,
+		Conn:         conn,
+		Window:       NewWindowDefault(),
+		Settings:     conn.Settings,
+		PeerSettings: conn.PeerSettings,
+		State:        IDLE,
+		ReadChan:     make(chan Frame, 4),
+	}
+}
+
+// ChangeState advances the stream's state machine for frame, which was
+// either sent or received depending on dir.
+func (stream *Stream) ChangeState(frame Frame, dir Direction) error {
+	header := frame.Header()
+
+	if header.Type == RstStreamFrameType {
+		stream.State = CLOSED
+		return nil
+	}
+
+	if stream.State == IDLE && header.Type == HeadersFrameType {
+		stream.State = OPEN
+	}
+
+	if header.Flags&END_STREAM != 0 {
+		switch {
+		case dir == RECV && stream.State == HALF_CLOSED_LOCAL:
+			stream.State = CLOSED
+		case dir == SEND && stream.State == HALF_CLOSED_REMOTE:
+			stream.State = CLOSED
+		case dir == RECV:
+			stream.State = HALF_CLOSED_REMOTE
+		case dir == SEND:
+			stream.State = HALF_CLOSED_LOCAL
+		}
+	}
+
+	return nil
+}
+
+// Close marks the stream CLOSED and unblocks anyone waiting in Recv by
+// closing ReadChan, delivering err to them - e.g. a *GoAwayError when the
+// connection is torn down (GOAWAY or GracefulTimeout) with the stream
+// still outstanding. A stream already in state CLOSED is left as it is,
+// so calling Close again is a no-op.
+func (stream *Stream) Close(err error) {
+	if stream.State == CLOSED {
+		return
+	}
+	stream.State = CLOSED
+	stream.err = err
+	close(stream.ReadChan)
+}
+
+// Send queues frame for the connection's loopyWriter. DATA frames are
+// handed to writeData so they're chopped and scheduled against send
+// window/SETTINGS_MAX_FRAME_SIZE alongside every other stream's DATA;
+// everything else goes straight onto conn.controlBuf.
 func (stream *Stream) Send(frame Frame) {
-	stream.Conn.WriteFrame(frame) // err
+	if data, ok := frame.(*DataFrame); ok {
+		stream.writeData(data.Data, data.Flags&END_STREAM != 0)
+		return
+	}
+	stream.Conn.controlBuf.put(frame)
 }
 
-func (stream *Stream) Recv() Frame {
-	frame := stream.Conn.ReadFrame() // err
-	return frame
+// Recv blocks for the next frame ReadLoop has dispatched to this stream.
+// Frames only ever reach ReadChan via conn.readFrame(), so a HEADERS
+// frame that arrived split across CONTINUATION frames is always already
+// merged by the time it's seen here. If the connection is torn down
+// while Recv is waiting, ReadChan is closed and Recv returns the error
+// Close recorded (e.g. *GoAwayError) instead of blocking forever.
+func (stream *Stream) Recv() (Frame, error) {
+	frame, ok := <-stream.ReadChan
+	if !ok {
+		return nil, stream.err
+	}
+	return frame, nil
 }
 
 func (stream *Stream) SendRequest(req *http.Request) {
 	stream.req = req
 	if req.Method == "GET" {
-		frame := NewHeadersFrame(END_STREAM+END_HEADERS, stream.Id)
+		frame := NewHeadersFrame(END_STREAM+END_HEADERS, stream.ID)
 		frame.Headers = req.Header
 		frame.HeaderBlock = stream.Conn.EncodeHeader(frame.Headers)
 		frame.Length = uint16(len(frame.HeaderBlock))
 		stream.Send(frame) // err
 	} else if req.Method == "POST" {
-		frame := NewHeadersFrame(END_HEADERS, stream.Id)
+		frame := NewHeadersFrame(END_HEADERS, stream.ID)
 		frame.Headers = req.Header
 		frame.HeaderBlock = stream.Conn.EncodeHeader(frame.Headers)
 		frame.Length = uint16(len(frame.HeaderBlock))
 		stream.Send(frame) // err
 
-		data := NewDataFrame(0, stream.Id)
+		data := NewDataFrame(0, stream.ID)
 		data.Data, _ = ioutil.ReadAll(req.Body) // err
 		data.Length = uint16(len(data.Data))
 		stream.Send(data)
 
-		data = NewDataFrame(END_STREAM, stream.Id)
+		data = NewDataFrame(END_STREAM, stream.ID)
 		stream.Send(data)
 	}
 }
 
-func (stream *Stream) RecvResponse() *http.Response {
+func (stream *Stream) RecvResponse() (*http.Response, error) {
 	c := 0
 	header := http.Header{}
 	resBody := bytes.NewBuffer([]byte{})
 
 	for {
-		frame := stream.Recv()
+		frame, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
 		frameHeader := frame.Header()
 
 		if frameHeader.Type == HeadersFrameType {
@@ -97,5 +207,5 @@ func (stream *Stream) RecvResponse() *http.Response {
 		Trailer:          nil,
 		Request:          stream.req,
 	}
-	return res
+	return res, nil
 }
@@ -0,0 +1,61 @@
+package http2
+
+import (
+	. "github.com/Jxck/http2/frame"
+	"testing"
+)
+
+func TestChangeStateIdleToOpenOnHeaders(t *testing.T) {
+	stream := &Stream{State: IDLE}
+	frame := NewHeadersFrame(UNSET, 1)
+	if err := stream.ChangeState(frame, RECV); err != nil {
+		t.Fatalf("ChangeState: %v", err)
+	}
+	if stream.State != OPEN {
+		t.Fatalf("State = %v, want OPEN", stream.State)
+	}
+}
+
+func TestChangeStateEndStreamRecvHalfClosesRemote(t *testing.T) {
+	stream := &Stream{State: OPEN}
+	frame := NewHeadersFrame(END_STREAM, 1)
+	if err := stream.ChangeState(frame, RECV); err != nil {
+		t.Fatalf("ChangeState: %v", err)
+	}
+	if stream.State != HALF_CLOSED_REMOTE {
+		t.Fatalf("State = %v, want HALF_CLOSED_REMOTE", stream.State)
+	}
+}
+
+func TestChangeStateEndStreamSendHalfClosesLocal(t *testing.T) {
+	stream := &Stream{State: OPEN}
+	frame := NewHeadersFrame(END_STREAM, 1)
+	if err := stream.ChangeState(frame, SEND); err != nil {
+		t.Fatalf("ChangeState: %v", err)
+	}
+	if stream.State != HALF_CLOSED_LOCAL {
+		t.Fatalf("State = %v, want HALF_CLOSED_LOCAL", stream.State)
+	}
+}
+
+func TestChangeStateEndStreamClosesWhenOtherHalfAlreadyClosed(t *testing.T) {
+	stream := &Stream{State: HALF_CLOSED_LOCAL}
+	frame := NewHeadersFrame(END_STREAM, 1)
+	if err := stream.ChangeState(frame, RECV); err != nil {
+		t.Fatalf("ChangeState: %v", err)
+	}
+	if stream.State != CLOSED {
+		t.Fatalf("State = %v, want CLOSED", stream.State)
+	}
+}
+
+func TestChangeStateRstStreamClosesRegardlessOfDirection(t *testing.T) {
+	stream := &Stream{State: OPEN}
+	frame := NewRstStreamFrame(1, NO_ERROR)
+	if err := stream.ChangeState(frame, RECV); err != nil {
+		t.Fatalf("ChangeState: %v", err)
+	}
+	if stream.State != CLOSED {
+		t.Fatalf("State = %v, want CLOSED", stream.State)
+	}
+}
@@ -0,0 +1,76 @@
+package http2
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Transport implements http.RoundTripper on top of the Conn/Stream
+// primitives in this package, letting an unmodified net/http client speak
+// HTTP/2 to servers that support it.
+type Transport struct {
+	// AllowHTTP, when true, lets RoundTrip use the h2c prior-knowledge
+	// preface for "http://" URLs instead of refusing them. Without it,
+	// only "https://" requests (negotiated via ALPN) are served.
+	AllowHTTP bool
+
+	pool *clientConnPool
+}
+
+func NewTransport() *Transport {
+	return &Transport{
+		pool: NewClientConnPool(),
+	}
+}
+
+// RoundTrip satisfies http.RoundTripper: it resolves req's authority to a
+// (possibly reused) Conn and sends the request over a new stream on it.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.URL.Scheme {
+	case "https":
+	case "http":
+		if !t.AllowHTTP {
+			return nil, fmt.Errorf("http2: refusing to make http request to %s since Transport.AllowHTTP is false", req.URL)
+		}
+	default:
+		return nil, fmt.Errorf("http2: unsupported scheme %q", req.URL.Scheme)
+	}
+
+	if t.pool == nil {
+		t.pool = NewClientConnPool()
+	}
+
+	addr := authorityAddr(req.URL)
+	conn, err := t.pool.GetClientConn(req, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := conn.RoundTrip(req)
+	if _, ok := err.(*GoAwayError); ok {
+		// conn was already marked dead in the pool when the GOAWAY came
+		// in; a fresh GetClientConn dials a new one to retry on.
+		conn, err = t.pool.GetClientConn(req, addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn.RoundTrip(req)
+	}
+	return res, err
+}
+
+// authorityAddr returns the "host:port" to dial for u, defaulting the port
+// from the scheme when one isn't explicit.
+func authorityAddr(u *url.URL) string {
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "443"
+	if u.Scheme == "http" {
+		port = "80"
+	}
+	return net.JoinHostPort(host, port)
+}